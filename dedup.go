@@ -0,0 +1,214 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dep
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// HardlinkCache maps content hashes to a canonical on-disk path that
+// CopyDirDedup can link additional copies of the same content from.
+type HardlinkCache interface {
+	// Canonical returns the canonical path previously stored for hash,
+	// and whether one was found.
+	Canonical(hash string) (path string, ok bool, err error)
+
+	// Store records path as the canonical location for hash. It is
+	// called each time CopyDirDedup copies a file's bytes instead of
+	// linking them: the first time it sees a given hash, and again
+	// whenever the canonical copy already recorded could not be reused.
+	Store(hash, path string) error
+}
+
+// CopyDirDedup recursively copies src to dst like CopyDir, but for every
+// regular file it first hashes the content with SHA-256 and consults
+// cache for a canonical copy already on disk. When a canonical copy is
+// found on the same filesystem, with the same mode as the source file,
+// the destination is linked to it - with
+// a copy-on-write reflink where the filesystem supports one, falling
+// back to a plain hardlink - instead of copying the bytes again. The
+// first copy of any given content becomes its canonical copy and is
+// recorded in cache for reuse by later calls.
+//
+// Vendor trees across a user's projects overlap heavily - the same
+// LICENSE files and common subpackages of popular dependencies get
+// vendored again and again - so sharing a single blob store this way
+// cuts disk usage from running dep ensure across many projects
+// substantially.
+func CopyDirDedup(src, dst string, cache HardlinkCache) error {
+	src = filepath.Clean(src)
+	dst = filepath.Clean(dst)
+
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("source %q is not a directory", src)
+	}
+
+	if _, err = os.Stat(dst); err != nil && !os.IsNotExist(err) {
+		return err
+	} else if err == nil {
+		return fmt.Errorf("destination already exists")
+	}
+
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		dstPath := filepath.Join(dst, rel)
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			return copySymlink(p, dstPath)
+		case info.IsDir():
+			if err := os.MkdirAll(dstPath, info.Mode()); err != nil {
+				return err
+			}
+			return os.Chmod(dstPath, info.Mode())
+		default:
+			return copyFileDedup(p, dstPath, cache)
+		}
+	})
+}
+
+// copyFileDedup copies src to dst via cache, as described by
+// CopyDirDedup.
+func copyFileDedup(src, dst string, cache HardlinkCache) error {
+	si, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	hash, err := hashFile(src)
+	if err != nil {
+		return err
+	}
+
+	if canonical, ok, err := cache.Canonical(hash); err != nil {
+		return err
+	} else if ok {
+		// Only reuse the canonical copy if it still exists and has the
+		// same mode as src: files are hardlinked, not copied, so they
+		// share a single inode, and linking in a file with a different
+		// mode would silently change the mode - and any later mutation
+		// - of every other copy sharing that inode.
+		if ci, err := os.Stat(canonical); err == nil && ci.Mode() == si.Mode() {
+			if err := linkOrReflink(canonical, dst); err == nil {
+				// A hardlink already shares canonical's mode by
+				// definition, but a reflink creates dst as a new file
+				// via os.Create, so its mode must be brought into
+				// line with si explicitly.
+				return os.Chmod(dst, si.Mode())
+			}
+		}
+		// The canonical copy is unusable from here - removed out from
+		// under us, a different mode, or on a different filesystem - so
+		// fall through and copy the bytes ourselves instead.
+	}
+
+	if err := CopyFile(src, dst); err != nil {
+		return err
+	}
+
+	// dst has already been copied successfully at this point, so a
+	// failure to record it as the new canonical copy - the cache living
+	// on a different filesystem, being full, etc. - shouldn't fail the
+	// caller. It just means this content won't be deduplicated until a
+	// future call succeeds in storing it.
+	if err := cache.Store(hash, dst); err != nil {
+		log.Printf("dep: failed to cache %q as the canonical copy for %s: %s", dst, hash, err)
+	}
+
+	return nil
+}
+
+// hashFile returns the hex-encoded SHA-256 digest of the file at path.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// reflink is a var, rather than a direct call to reflinkFile, so tests
+// can fake FICLONE behavior without needing a real btrfs/xfs
+// filesystem.
+var reflink = reflinkFile
+
+// linkOrReflink makes dst share the same underlying content as src,
+// preferring a copy-on-write reflink where the filesystem supports one
+// and falling back to a regular hardlink otherwise.
+func linkOrReflink(src, dst string) error {
+	if err := reflink(src, dst); err == nil {
+		return nil
+	}
+	return os.Link(src, dst)
+}
+
+// dirHardlinkCache is the default HardlinkCache. It stores canonical
+// paths as a directory of hardlinks, sharded two levels deep by hash
+// prefix to keep any one directory from growing too large, and so the
+// cache itself survives process restarts and can be shared across dep
+// invocations and even across projects. Store keeps an entry that
+// already exists for a hash; it does not replace it.
+type dirHardlinkCache struct {
+	dir string
+}
+
+// NewDirHardlinkCache returns a HardlinkCache backed by dir, creating it
+// if it does not already exist.
+func NewDirHardlinkCache(dir string) (HardlinkCache, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	return &dirHardlinkCache{dir: dir}, nil
+}
+
+func (c *dirHardlinkCache) entry(hash string) string {
+	return filepath.Join(c.dir, hash[:2], hash[2:])
+}
+
+func (c *dirHardlinkCache) Canonical(hash string) (string, bool, error) {
+	entry := c.entry(hash)
+	if _, err := os.Stat(entry); err != nil {
+		if os.IsNotExist(err) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	return entry, true, nil
+}
+
+func (c *dirHardlinkCache) Store(hash, path string) error {
+	entry := c.entry(hash)
+	if err := os.MkdirAll(filepath.Dir(entry), 0777); err != nil {
+		return err
+	}
+	if err := os.Link(path, entry); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
@@ -5,11 +5,16 @@
 package dep
 
 import (
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/golang/dep/internal/test"
 )
@@ -97,6 +102,434 @@ func TestCopyDir(t *testing.T) {
 	}
 }
 
+func TestCopyDirWithParallel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srcdir := filepath.Join(dir, "src")
+	const numFiles = 2000
+	for i := 0; i < numFiles; i++ {
+		p := filepath.Join(srcdir, fmt.Sprintf("dir%d", i%20), fmt.Sprintf("file%d", i))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(fmt.Sprintf("contents %d", i)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Progress may be called concurrently, so calls can finish out of
+	// order; keep the largest totals reported rather than the last ones.
+	storeMax := func(addr *int64, v int64) {
+		for {
+			old := atomic.LoadInt64(addr)
+			if v <= old || atomic.CompareAndSwapInt64(addr, old, v) {
+				return
+			}
+		}
+	}
+
+	var bytesCopied, filesCopied int64
+	destdir := filepath.Join(dir, "dest")
+	opts := CopyDirOptions{
+		Concurrency: 8,
+		Progress: func(b, f int64) {
+			storeMax(&bytesCopied, b)
+			storeMax(&filesCopied, f)
+		},
+	}
+	if err := CopyDirWith(srcdir, destdir, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := atomic.LoadInt64(&filesCopied); got != numFiles {
+		t.Fatalf("expected progress to report %d files copied, got %d", numFiles, got)
+	}
+	if atomic.LoadInt64(&bytesCopied) == 0 {
+		t.Fatal("expected progress to report a nonzero number of bytes copied")
+	}
+
+	for i := 0; i < numFiles; i++ {
+		rel := filepath.Join(fmt.Sprintf("dir%d", i%20), fmt.Sprintf("file%d", i))
+		want := fmt.Sprintf("contents %d", i)
+		got, err := ioutil.ReadFile(filepath.Join(destdir, rel))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Fatalf("expected: %s, got: %s", want, string(got))
+		}
+	}
+}
+
+func TestCopyDirWithCancelsOnError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srcdir := filepath.Join(dir, "src")
+	if err := os.MkdirAll(srcdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	const numFiles = 500
+	for i := 0; i < numFiles; i++ {
+		p := filepath.Join(srcdir, fmt.Sprintf("file%d", i))
+		if err := ioutil.WriteFile(p, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Make one file in the middle of the walk unreadable, so its copy
+	// fails partway through and the remaining jobs should be canceled.
+	bad := filepath.Join(srcdir, "file250")
+	if err := os.Chmod(bad, 0222); err != nil {
+		t.Fatal(err)
+	}
+
+	var filesCopied int64
+	destdir := filepath.Join(dir, "dest")
+	opts := CopyDirOptions{
+		Concurrency: 4,
+		Progress: func(_, f int64) {
+			atomic.StoreInt64(&filesCopied, f)
+		},
+	}
+
+	if err := CopyDirWith(srcdir, destdir, opts); err == nil {
+		t.Fatal("expected an error from CopyDirWith, got none")
+	}
+
+	// The unreadable file is never counted, so without cancellation the
+	// other numFiles-1 files would all be reported as copied.
+	if got := atomic.LoadInt64(&filesCopied); got >= numFiles-1 {
+		t.Fatalf("expected cancellation to stop short of copying all %d readable files, copied %d", numFiles-1, got)
+	}
+}
+
+func TestCopyDirDedup(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		// XXX: hardlinks and inode semantics work differently on
+		// Microsoft Windows. Skipping this until a compatible
+		// implementation is provided.
+		t.Skip("skipping on windows")
+	}
+
+	dir, err := ioutil.TempDir("", "dep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := NewDirHardlinkCache(filepath.Join(dir, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const contents = "MIT License text"
+
+	// Two unrelated source trees containing a file with identical
+	// content, deduplicated against the same cache.
+	for _, name := range []string{"one", "two"} {
+		srcdir := filepath.Join(dir, name, "src")
+		if err := os.MkdirAll(srcdir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(srcdir, "LICENSE"), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		dstdir := filepath.Join(dir, name, "dst")
+		if err := CopyDirDedup(srcdir, dstdir, cache); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var inodes []uint64
+	for _, name := range []string{"one", "two"} {
+		fn := filepath.Join(dir, name, "dst", "LICENSE")
+
+		got, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != contents {
+			t.Fatalf("expected: %s, got: %s", contents, string(got))
+		}
+
+		fi, err := os.Stat(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			t.Fatal("expected a *syscall.Stat_t")
+		}
+		if st.Nlink < 2 {
+			t.Fatalf("expected %s to have Nlink >= 2, got %d", fn, st.Nlink)
+		}
+		inodes = append(inodes, st.Ino)
+	}
+
+	if inodes[0] != inodes[1] {
+		t.Fatalf("expected both copies to share an inode, got %d and %d", inodes[0], inodes[1])
+	}
+}
+
+func TestCopyDirDedupModeMismatch(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		// XXX: hardlinks and inode semantics work differently on
+		// Microsoft Windows. Skipping this until a compatible
+		// implementation is provided.
+		t.Skip("skipping on windows")
+	}
+
+	dir, err := ioutil.TempDir("", "dep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := NewDirHardlinkCache(filepath.Join(dir, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const contents = "identical bytes, different modes"
+	modes := []os.FileMode{0644, 0600}
+
+	for i, mode := range modes {
+		name := fmt.Sprintf("proj%d", i)
+		srcdir := filepath.Join(dir, name, "src")
+		if err := os.MkdirAll(srcdir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(srcdir, "file"), []byte(contents), mode); err != nil {
+			t.Fatal(err)
+		}
+
+		dstdir := filepath.Join(dir, name, "dst")
+		if err := CopyDirDedup(srcdir, dstdir, cache); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, mode := range modes {
+		name := fmt.Sprintf("proj%d", i)
+		fn := filepath.Join(dir, name, "dst", "file")
+
+		fi, err := os.Stat(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode() != mode {
+			t.Fatalf("expected %s to keep mode %v, got %v", fn, mode, fi.Mode())
+		}
+	}
+}
+
+// fakeReflink simulates the FICLONE codepath on a filesystem that
+// doesn't actually support it: it copies src's bytes to a dst created
+// with os.Create's mode, just like reflinkFile does before issuing the ioctl, but
+// skips the ioctl itself. This lets tests exercise linkOrReflink's
+// reflink branch - and in particular, that copyFileDedup fixes up dst's
+// mode afterward - without needing a real btrfs/xfs filesystem.
+func fakeReflink(src, dst string) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, data, 0666)
+}
+
+func TestCopyDirDedupReflinkPreservesMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		// XXX: hardlinks and inode semantics work differently on
+		// Microsoft Windows. Skipping this until a compatible
+		// implementation is provided.
+		t.Skip("skipping on windows")
+	}
+
+	orig := reflink
+	reflink = fakeReflink
+	defer func() { reflink = orig }()
+
+	dir, err := ioutil.TempDir("", "dep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := NewDirHardlinkCache(filepath.Join(dir, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const contents = "identical bytes, same mode, reflinked"
+	const mode os.FileMode = 0600
+
+	for _, name := range []string{"one", "two"} {
+		srcdir := filepath.Join(dir, name, "src")
+		if err := os.MkdirAll(srcdir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(srcdir, "file"), []byte(contents), mode); err != nil {
+			t.Fatal(err)
+		}
+
+		dstdir := filepath.Join(dir, name, "dst")
+		if err := CopyDirDedup(srcdir, dstdir, cache); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// "two" is copied in via fakeReflink, which - like the real FICLONE
+	// path - creates its destination with os.Create's default mode
+	// rather than src's. copyFileDedup must chmod it back to match.
+	fn := filepath.Join(dir, "two", "dst", "file")
+	fi, err := os.Stat(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode() != mode {
+		t.Fatalf("expected %s to have mode %v, got %v", fn, mode, fi.Mode())
+	}
+}
+
+// storeFailingCache wraps a HardlinkCache and makes every Store call
+// fail, to simulate a cache that cannot be written to (e.g. it lives on
+// a different, full, or read-only filesystem).
+type storeFailingCache struct {
+	HardlinkCache
+}
+
+func (c storeFailingCache) Store(hash, path string) error {
+	return fmt.Errorf("simulated failure storing %s", hash)
+}
+
+func TestCopyDirDedupToleratesStoreFailure(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		// XXX: hardlinks and inode semantics work differently on
+		// Microsoft Windows. Skipping this until a compatible
+		// implementation is provided.
+		t.Skip("skipping on windows")
+	}
+
+	dir, err := ioutil.TempDir("", "dep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	base, err := NewDirHardlinkCache(filepath.Join(dir, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := storeFailingCache{base}
+
+	srcdir := filepath.Join(dir, "src")
+	if err := os.MkdirAll(srcdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(srcdir, "file"), []byte("hello world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dstdir := filepath.Join(dir, "dst")
+	if err := CopyDirDedup(srcdir, dstdir, cache); err != nil {
+		t.Fatalf("expected CopyDirDedup to tolerate a Store failure, got: %s", err)
+	}
+
+	got, err := ioutil.ReadFile(filepath.Join(dstdir, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello world" {
+		t.Fatalf("expected: %s, got: %s", "hello world", string(got))
+	}
+}
+
+func TestCopyDirManifestAndVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srcdir := filepath.Join(dir, "src")
+	files := map[string]string{
+		"myfile": "hello world",
+		filepath.Join("sub", "f"): "subdir file",
+	}
+	for rel, contents := range files {
+		p := filepath.Join(srcdir, rel)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if runtime.GOOS != "windows" {
+		if err := os.Symlink("myfile", filepath.Join(srcdir, "mylink")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	destdir := filepath.Join(dir, "dest")
+	if err := CopyDirWith(srcdir, destdir, CopyDirOptions{Manifest: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := VerifyDir(destdir); err != nil {
+		t.Fatalf("expected freshly copied tree to verify clean, got: %s", err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(destdir, manifestFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range manifest.Entries {
+		if entry.Path == manifestFileName {
+			t.Fatalf("expected manifest to exclude itself, found an entry for %s", manifestFileName)
+		}
+	}
+	if len(manifest.Entries) != len(files) {
+		t.Fatalf("expected %d manifest entries, got %d", len(files), len(manifest.Entries))
+	}
+
+	// Mutate one recorded file post-copy.
+	mutated := filepath.Join(destdir, "myfile")
+	if err := ioutil.WriteFile(mutated, []byte("tampered"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err = VerifyDir(destdir)
+	if err == nil {
+		t.Fatal("expected VerifyDir to report an error after mutation, got none")
+	}
+	verr, ok := err.(*VerifyError)
+	if !ok {
+		t.Fatalf("expected a *VerifyError, got %T: %s", err, err)
+	}
+	if len(verr.Mutated) != 1 || verr.Mutated[0] != "myfile" {
+		t.Fatalf("expected Mutated to be [myfile], got %v", verr.Mutated)
+	}
+	if len(verr.Missing) != 0 || len(verr.Extra) != 0 {
+		t.Fatalf("expected no missing or extra paths, got missing=%v extra=%v", verr.Missing, verr.Extra)
+	}
+}
+
 func TestCopyDirFailSrc(t *testing.T) {
 	if runtime.GOOS == "windows" {
 		// XXX: setting permissions works differently in
@@ -498,3 +931,258 @@ func TestIsEmpty(t *testing.T) {
 		}
 	}
 }
+
+// fakeXDevRename simulates a rename across filesystems by always failing
+// with the same error a real cross-device os.Rename would.
+func fakeXDevRename(src, dst string) error {
+	return &os.LinkError{Op: "rename", Old: src, New: dst, Err: syscall.EXDEV}
+}
+
+func TestRenameWithFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	if err := ioutil.WriteFile(src, []byte("hello world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(dir, "dst")
+
+	orig := rename
+	rename = fakeXDevRename
+	defer func() { rename = orig }()
+
+	if err := RenameWithFallback(src, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be removed after fallback, got err: %v", src, err)
+	}
+
+	got, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello world" {
+		t.Fatalf("expected: %s, got: %s", "hello world", string(got))
+	}
+}
+
+func TestRenameWithFallbackDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(filepath.Join(src, "subdir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "subdir", "file"), []byte("subdir file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(dir, "dst")
+
+	orig := rename
+	rename = fakeXDevRename
+	defer func() { rename = orig }()
+
+	if err := RenameWithFallback(src, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be removed after fallback, got err: %v", src, err)
+	}
+
+	got, err := ioutil.ReadFile(filepath.Join(dst, "subdir", "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "subdir file" {
+		t.Fatalf("expected: %s, got: %s", "subdir file", string(got))
+	}
+}
+
+func TestRenameWithFallbackPreservesModTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	if err := ioutil.WriteFile(src, []byte("hello world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	wantMtime := time.Date(2011, 1, 26, 3, 4, 5, 0, time.UTC)
+	wantAtime := time.Date(2011, 1, 26, 6, 7, 8, 0, time.UTC)
+	if err := os.Chtimes(src, wantAtime, wantMtime); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(dir, "dst")
+
+	orig := rename
+	rename = fakeXDevRename
+	defer func() { rename = orig }()
+
+	if err := RenameWithFallback(src, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.ModTime().Equal(wantMtime) {
+		t.Fatalf("expected mtime %v, got %v", wantMtime, fi.ModTime())
+	}
+}
+
+func TestRenameWithFallbackFailOnNonXDevError(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		// XXX: skipped on Microsoft Windows, like the other
+		// failure tests in this file; this one sets no
+		// permissions itself.
+		t.Skip("skipping on windows")
+	}
+
+	dir, err := ioutil.TempDir("", "dep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "does_not_exist")
+	dst := filepath.Join(dir, "dst")
+
+	orig := rename
+	rename = func(src, dst string) error {
+		return &os.LinkError{Op: "rename", Old: src, New: dst, Err: syscall.ENOENT}
+	}
+	defer func() { rename = orig }()
+
+	if err := RenameWithFallback(src, dst); err == nil {
+		t.Fatalf("expected error for RenameWithFallback(%s, %s), got none", src, dst)
+	}
+}
+
+func TestInWritableDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		// XXX: setting permissions works differently in
+		// Microsoft Windows. Skipping this this until a
+		// compatible implementation is provided.
+		t.Skip("skipping on windows")
+	}
+
+	dir, err := ioutil.TempDir("", "dep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rwParent := filepath.Join(dir, "rw")
+	if err := os.MkdirAll(rwParent, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	roParent := filepath.Join(dir, "ro")
+	if err := os.MkdirAll(roParent, 0555); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(roParent, 0755)
+
+	tests := map[string]struct {
+		path    string
+		wantErr bool
+	}{
+		"rw parent":          {path: filepath.Join(rwParent, "file")},
+		"ro parent":          {path: filepath.Join(roParent, "file")},
+		"nonexistent parent": {path: filepath.Join(dir, "does_not_exist", "file"), wantErr: true},
+	}
+
+	for name, tt := range tests {
+		var called bool
+		err := InWritableDir(func(path string) error {
+			called = true
+			return ioutil.WriteFile(path, []byte("ok"), 0644)
+		}, tt.path)
+
+		if tt.wantErr {
+			if err == nil {
+				t.Fatalf("%s: expected error, got none", name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if !called {
+			t.Fatalf("%s: expected fn to be called", name)
+		}
+
+		got, err := ioutil.ReadFile(tt.path)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if string(got) != "ok" {
+			t.Fatalf("%s: expected: %s, got: %s", name, "ok", string(got))
+		}
+	}
+
+	fi, err := os.Stat(roParent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0555 {
+		t.Fatalf("expected %s to be restored to mode %v, got %v", roParent, os.FileMode(0555), fi.Mode().Perm())
+	}
+}
+
+func TestRemoveAllWritable(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		// XXX: setting permissions works differently in
+		// Microsoft Windows. Skipping this this until a
+		// compatible implementation is provided.
+		t.Skip("skipping on windows")
+	}
+
+	dir, err := ioutil.TempDir("", "dep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	parent := filepath.Join(dir, "ro")
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	target := filepath.Join(parent, "file")
+	if err := ioutil.WriteFile(target, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chmod(parent, 0555); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(parent, 0755)
+
+	if err := RemoveAllWritable(target); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be removed, got err: %v", target, err)
+	}
+}
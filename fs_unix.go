@@ -0,0 +1,16 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package dep
+
+import "syscall"
+
+// isCrossDeviceRenameErrno reports whether errno is the platform's
+// "invalid cross-device link" error, returned by rename(2) when src and
+// dst are on different filesystems.
+func isCrossDeviceRenameErrno(errno syscall.Errno) bool {
+	return errno == syscall.EXDEV
+}
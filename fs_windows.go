@@ -0,0 +1,20 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build windows
+
+package dep
+
+import "syscall"
+
+// ERROR_NOT_SAME_DEVICE is returned by MoveFile when src and dst are on
+// different volumes; Go's os.Rename surfaces it as this syscall.Errno.
+const windowsErrorNotSameDevice syscall.Errno = 17
+
+// isCrossDeviceRenameErrno reports whether errno is the platform's
+// "invalid cross-device link" error, returned when src and dst are on
+// different volumes.
+func isCrossDeviceRenameErrno(errno syscall.Errno) bool {
+	return errno == windowsErrorNotSameDevice
+}
@@ -0,0 +1,185 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dep
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// manifestFileName is the name of the manifest file CopyDirWith writes
+// at the destination root when CopyDirOptions.Manifest is set, and that
+// VerifyDir reads back.
+const manifestFileName = ".dep-manifest.json"
+
+// ManifestEntry records one file copied by CopyDirWith: its path
+// relative to the destination root, size, mode, and the SHA-256 digest
+// of its content at copy time.
+type ManifestEntry struct {
+	Path   string      `json:"path"`
+	Size   int64       `json:"size"`
+	Mode   os.FileMode `json:"mode"`
+	SHA256 string      `json:"sha256"`
+}
+
+// Manifest is the JSON document CopyDirWith writes to manifestFileName
+// and VerifyDir reads back, recording one ManifestEntry per file it
+// copied.
+type Manifest struct {
+	Entries []ManifestEntry `json:"entries"`
+}
+
+// copyFileHashing copies src to dst like copyFileCounting, additionally
+// computing the SHA-256 digest of the content in the same pass, so
+// building a manifest entry doesn't require a second read of the file.
+func copyFileHashing(src, dst string) (ManifestEntry, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+	defer in.Close()
+
+	h := sha256.New()
+	var n int64
+	err = InWritableDir(func(dst string) (err error) {
+		out, err := os.Create(dst)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if cerr := out.Close(); err == nil {
+				err = cerr
+			}
+		}()
+
+		n, err = io.Copy(io.MultiWriter(out, h), in)
+		return err
+	}, dst)
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+
+	si, err := os.Stat(src)
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+	if err := os.Chmod(dst, si.Mode()); err != nil {
+		return ManifestEntry{}, err
+	}
+
+	return ManifestEntry{
+		Size:   n,
+		Mode:   si.Mode(),
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+// VerifyError reports the paths under a VerifyDir root that didn't
+// match its manifest: Missing paths are recorded in the manifest but no
+// longer present, Extra paths are present but weren't recorded, and
+// Mutated paths are present and recorded but no longer match the
+// recorded size, mode, or content.
+type VerifyError struct {
+	Missing []string
+	Extra   []string
+	Mutated []string
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("tree does not match manifest: %d missing, %d extra, %d mutated", len(e.Missing), len(e.Extra), len(e.Mutated))
+}
+
+// VerifyDir re-hashes every file recorded in the manifest that a prior
+// CopyDirWith(..., CopyDirOptions{Manifest: true}) call wrote at dst,
+// and confirms the tree still matches it: nothing recorded has gone
+// missing, nothing's present that wasn't recorded, and no recorded
+// file's size, mode, or content has changed. It returns a *VerifyError
+// on any mismatch. Symlinks aren't recorded in the manifest in the
+// first place, so VerifyDir ignores them too.
+//
+// This gives dep ensure a cheap integrity check against post-vendoring
+// tampering or a partially-failed copy, and lets CI confirm vendor/
+// hasn't drifted from the state it was generated in.
+func VerifyDir(dst string) error {
+	data, err := ioutil.ReadFile(filepath.Join(dst, manifestFileName))
+	if err != nil {
+		return err
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return err
+	}
+
+	recorded := make(map[string]ManifestEntry, len(manifest.Entries))
+	for _, e := range manifest.Entries {
+		recorded[e.Path] = e
+	}
+
+	verr := &VerifyError{}
+
+	err = filepath.Walk(dst, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == dst || info.IsDir() || info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dst, p)
+		if err != nil {
+			return err
+		}
+		if rel == manifestFileName {
+			return nil
+		}
+
+		entry, ok := recorded[rel]
+		if !ok {
+			verr.Extra = append(verr.Extra, rel)
+			return nil
+		}
+		delete(recorded, rel)
+
+		if info.Size() != entry.Size || info.Mode() != entry.Mode {
+			verr.Mutated = append(verr.Mutated, rel)
+			return nil
+		}
+
+		hash, err := hashFile(p)
+		if err != nil {
+			return err
+		}
+		if hash != entry.SHA256 {
+			verr.Mutated = append(verr.Mutated, rel)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for rel := range recorded {
+		verr.Missing = append(verr.Missing, rel)
+	}
+
+	if len(verr.Missing) == 0 && len(verr.Extra) == 0 && len(verr.Mutated) == 0 {
+		return nil
+	}
+
+	sort.Strings(verr.Missing)
+	sort.Strings(verr.Extra)
+	sort.Strings(verr.Mutated)
+
+	return verr
+}
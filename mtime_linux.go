@@ -0,0 +1,22 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dep
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// fileTimes returns fi's access and modification times, read from the
+// underlying syscall.Stat_t so the access time survives even though
+// os.FileInfo only exposes ModTime.
+func fileTimes(fi os.FileInfo) (atime, mtime time.Time) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fi.ModTime(), fi.ModTime()
+	}
+	return time.Unix(st.Atim.Sec, st.Atim.Nsec), time.Unix(st.Mtim.Sec, st.Mtim.Nsec)
+}
@@ -0,0 +1,19 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !linux
+
+package dep
+
+import (
+	"os"
+	"time"
+)
+
+// fileTimes returns fi's access and modification times. Platforms other
+// than Linux aren't covered by dep's syscall.Stat_t access time
+// handling, so the access time just falls back to ModTime.
+func fileTimes(fi os.FileInfo) (atime, mtime time.Time) {
+	return fi.ModTime(), fi.ModTime()
+}
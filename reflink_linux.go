@@ -0,0 +1,40 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dep
+
+import (
+	"os"
+	"syscall"
+)
+
+// ficlone is the Linux FICLONE ioctl request number, used to ask a
+// copy-on-write filesystem (btrfs, xfs, overlayfs) to make one file a
+// reflink of another instead of copying its bytes.
+const ficlone = 0x40049409
+
+// reflinkFile asks the kernel to make dst share the same underlying
+// extents as src, copy-on-write, via the FICLONE ioctl. It only
+// succeeds on filesystems that support FICLONE, and only when src and
+// dst are on the same filesystem.
+func reflinkFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, out.Fd(), ficlone, in.Fd())
+	if errno != 0 {
+		os.Remove(dst)
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !linux
+
+package dep
+
+import "errors"
+
+// reflinkFile is only implemented on Linux, via FICLONE. Elsewhere it
+// always reports that reflinking is unsupported, so callers fall back
+// to a hardlink or a plain byte copy.
+func reflinkFile(src, dst string) error {
+	return errors.New("reflink: not supported on this platform")
+}